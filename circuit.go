@@ -0,0 +1,129 @@
+package main
+
+// circuit.go implements a simple per-target circuit breaker: once a target
+// has failed BreakerPolicy.FailureThreshold times inside Window, sendEvent
+// short-circuits further sends (no HTTP attempt) for Cooldown, then lets a
+// single probe request through to decide whether to close again.
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerPolicy configures the circuit breaker for an eventTarget.
+type BreakerPolicy struct {
+	// FailureThreshold is how many failures inside Window trip the breaker
+	FailureThreshold int
+	// Window is how far back failures are counted towards FailureThreshold
+	Window time.Duration
+	// Cooldown is how long the breaker stays open before allowing a probe
+	Cooldown time.Duration
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker tracks recent failures for a single target's queueURL and
+// decides whether a send should be allowed through.
+type circuitBreaker struct {
+	qu     queueURL
+	policy BreakerPolicy
+
+	mu       sync.Mutex
+	failures []time.Time
+	state    breakerState
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(qu queueURL, policy BreakerPolicy) *circuitBreaker {
+	return &circuitBreaker{qu: qu, policy: policy}
+}
+
+// allow reports whether a send should proceed: always true while closed,
+// false while open (until Cooldown has passed), and true for exactly one
+// probe request per cooldown period while half-open.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.policy.Cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// recordSuccess closes the breaker and clears failure history.
+func (b *circuitBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = nil
+	b.probing = false
+	b.setState(breakerClosed)
+}
+
+// recordFailure appends to the failure window and trips the breaker open
+// once FailureThreshold failures have landed inside Window. A failed probe
+// while half-open sends it straight back to open for another cooldown.
+func (b *circuitBreaker) recordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+		return
+	}
+
+	now := time.Now()
+	cutoff := now.Add(-b.policy.Window)
+	kept := b.failures[:0]
+	for _, t := range b.failures {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	b.failures = append(kept, now)
+
+	if len(b.failures) >= b.policy.FailureThreshold {
+		b.openedAt = now
+		b.setState(breakerOpen)
+	}
+}
+
+// setState updates state and mirrors it to the breakerStateGauge metric.
+// Callers must hold b.mu.
+func (b *circuitBreaker) setState(s breakerState) {
+	b.state = s
+	breakerStateGauge.WithLabelValues(b.qu.Queue, b.qu.URL).Set(float64(s))
+}
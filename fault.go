@@ -0,0 +1,84 @@
+package main
+
+// fault.go implements optional per-target fault injection, so the
+// retry/backoff/circuit-breaker behavior can be exercised against a
+// simulated unstable downstream without standing up a flaky receiver.
+// Disabled by default even when configured: a send only has faults
+// injected if the triggering request carried the X-Sep-Fault header.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// sepFaultHeader must be present (non-empty) on the inbound request for a
+// target's FaultInjection to activate, so chaos testing can be triggered
+// per-request instead of for every request against a target.
+const sepFaultHeader = "X-Sep-Fault"
+
+// FaultInjection configures synthetic failures sendEvent can simulate
+// before ever calling client.Do.
+type FaultInjection struct {
+	// DropProbability is the chance, [0,1], that a request fails with a
+	// synthetic network error instead of reaching the target
+	DropProbability float64
+	// LatencyMeanMs/LatencyStddevMs add randomized delay before the call
+	LatencyMeanMs   float64
+	LatencyStddevMs float64
+	// ForcedStatusCodes maps a status code to the probability, [0,1], that
+	// it's returned instead of actually calling the target
+	ForcedStatusCodes map[int]float64
+}
+
+// injectedFault is a synthetic outcome from applyFaultInjection: either a
+// dropped connection or a forced status code, never both.
+type injectedFault struct {
+	err  error
+	code int
+}
+
+// response turns an injectedFault into the (resp, err) pair sendEvent
+// expects back from client.Do.
+func (f injectedFault) response() (*http.Response, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &http.Response{
+		StatusCode: f.code,
+		Body:       io.NopCloser(bytes.NewReader(nil)),
+	}, nil
+}
+
+// applyFaultInjection decides whether to simulate latency and/or a
+// synthetic failure for this attempt, per fi. ok is false when no fault
+// should be injected (fi is nil, or the request didn't carry
+// sepFaultHeader, or neither the drop nor any forced code rolled), in
+// which case the caller should proceed with the real request.
+func applyFaultInjection(fi *FaultInjection, headers http.Header) (injectedFault, bool) {
+	if fi == nil || headers.Get(sepFaultHeader) == "" {
+		return injectedFault{}, false
+	}
+
+	if fi.LatencyMeanMs > 0 || fi.LatencyStddevMs > 0 {
+		delayMs := fi.LatencyMeanMs + rand.NormFloat64()*fi.LatencyStddevMs
+		if delayMs > 0 {
+			time.Sleep(time.Duration(delayMs * float64(time.Millisecond)))
+		}
+	}
+
+	if fi.DropProbability > 0 && rand.Float64() < fi.DropProbability {
+		return injectedFault{err: fmt.Errorf("sep: fault injection: simulated connection drop")}, true
+	}
+
+	for code, probability := range fi.ForcedStatusCodes {
+		if probability > 0 && rand.Float64() < probability {
+			return injectedFault{code: code}, true
+		}
+	}
+
+	return injectedFault{}, false
+}
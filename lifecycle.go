@@ -0,0 +1,140 @@
+package main
+
+// lifecycle.go wires up graceful shutdown: SIGINT/SIGTERM and the
+// /_admin/shutdown endpoint both trigger the same drain-and-exit sequence,
+// so a deploy or restart doesn't drop whatever's still sitting in a
+// worker's RequestChan. /_admin/restart re-reads the config in place
+// without tearing any of that down.
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// shutdownGrace is how long the HTTP listener is given to finish in-flight
+// requests before we move on to draining queues.
+const shutdownGrace = 10 * time.Second
+
+// drainDeadline is how long workers are given to flush whatever's left in
+// RequestChan via sendEvent before we spill the rest to disk (for targets
+// with SpillDir) and close RequestChan.
+const drainDeadline = 30 * time.Second
+
+var workerWG sync.WaitGroup
+
+var shutdownOnce sync.Once
+
+// shutdown stops the HTTP listener, drains every worker's RequestChan
+// (falling back to disk, for targets with SpillDir, for anything that
+// doesn't finish sending in time),
+// and waits for all worker goroutines to exit before returning.
+func shutdown(srv *http.Server) {
+	shutdownOnce.Do(func() {
+		log.Info("shutdown-begin")
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("shutdown-http-error")
+		}
+
+		targetsMu.Lock()
+		deadline := time.Now().Add(drainDeadline)
+		for qu, w := range sendPool {
+			drainWorker(qu, w, deadline)
+		}
+		targetsMu.Unlock()
+
+		workerWG.Wait()
+		log.Info("shutdown-complete")
+	})
+}
+
+// drainWorker waits (up to deadline) for w's in-flight RequestChan to empty
+// out via sendEvent, spills anything left over to disk if spill is
+// configured, then closes RequestChan so the worker goroutine exits.
+func drainWorker(qu queueURL, w worker, deadline time.Time) {
+	if remaining := len(w.RequestChan); remaining > 0 {
+		log.WithFields(log.Fields{"queue": qu.Queue, "url": qu.URL, "remaining": remaining}).Info("shutdown-draining")
+	}
+
+	for len(w.RequestChan) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if w.Spill != nil {
+		// stop the feeder first and wait for it to exit, so it can't be
+		// mid-send to RequestChan when we close it below
+		w.Spill.stop()
+
+		for {
+			select {
+			case req := <-w.RequestChan:
+				if err := w.Spill.append(req); err != nil {
+					log.WithFields(log.Fields{"queue": qu.Queue, "url": qu.URL, "err": err}).Warn("shutdown-spill-error")
+				}
+			default:
+				close(w.RequestChan)
+				return
+			}
+		}
+	}
+
+	close(w.RequestChan)
+}
+
+// installSignalHandlers traps SIGINT/SIGTERM and runs the same shutdown
+// sequence the admin endpoint uses.
+func installSignalHandlers(srv *http.Server) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		log.WithFields(log.Fields{"signal": sig.String()}).Info("signal-received")
+		shutdown(srv)
+		os.Exit(0)
+	}()
+}
+
+// handleAdminShutdown lets operators trigger the same graceful shutdown
+// sequence over HTTP, e.g. from an orchestrator's pre-stop hook.
+func handleAdminShutdown(srv *http.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Write([]byte("shutting down\n"))
+		go func() {
+			shutdown(srv)
+			os.Exit(0)
+		}()
+	}
+}
+
+// handleAdminRestart re-reads the config file at path and rebuilds
+// targets/sendPool in place via ReloadConfig: targets that still exist
+// keep their worker and RequestChan untouched (unless BufferLen changed,
+// in which case RequestChan is rebuilt), new targets get a fresh
+// worker, and removed targets are drained before being torn down.
+func handleAdminRestart(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := ReloadConfig(path); err != nil {
+			log.WithFields(log.Fields{"err": err}).Warn("admin-restart-failed")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("restarted\n"))
+	}
+}
@@ -6,10 +6,12 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/nu7hatch/gouuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"runtime"
+	"sync"
 	"time"
 )
 
@@ -22,6 +24,30 @@ type eventTarget struct {
 	URL string
 	// BufferLen is how large the chan will be made for this EventTarget
 	BufferLen uint64
+	// SpillDir, if set, enables an on-disk overflow log for this target:
+	// once RequestChan is above its high-water mark, new requestMessages
+	// are appended here instead of being dropped
+	SpillDir string
+	// SpillMaxBytes caps the size of the on-disk overflow log; 0 means
+	// unbounded
+	SpillMaxBytes uint64
+	// Retry configures sendEvent's backoff/success behavior for this
+	// target; the zero value falls back to sensible defaults
+	Retry RetryPolicy
+	// Breaker, if non-nil, enables a circuit breaker for this target
+	Breaker *BreakerPolicy
+	// Fault, if non-nil, lets requests carrying X-Sep-Fault inject
+	// synthetic drops/latency/status codes before actually relaying
+	Fault *FaultInjection
+	// AuthSigning, if non-nil, HMAC-signs every relayed request so the
+	// downstream can verify authenticity and detect replays
+	AuthSigning *AuthSigning
+	// BearerToken, if set, is sent as "Authorization: Bearer <token>" for
+	// targets that just need a static token rather than full signing
+	BearerToken string
+	// BasicAuth, if non-nil, is sent as a standard Authorization: Basic
+	// header
+	BasicAuth *BasicAuth
 }
 
 // requestMessage represents an http event to be repeated to eventTargets
@@ -64,21 +90,37 @@ func handleIncomingEvent(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Fprintf(w, "{ \"id\":\"%s\" }\n", u5) // to lazy to do a real json.Marshal, etc
 
-	for _, eventTarget := range targets[queue] {
+	targetsMu.RLock()
+	eventTargets := targets[queue]
+	targetsMu.RUnlock()
+
+	for _, eventTarget := range eventTargets {
 		qu := queueURL{queue, eventTarget.URL}
 		addchan <- qu
+		targetsMu.RLock()
+		w := sendPool[qu]
+		targetsMu.RUnlock()
+
+		// once we're above the high-water mark, prefer spilling to disk
+		// over pushing straight into (and potentially overflowing) the chan
+		if w.Spill != nil && uint64(len(w.RequestChan)) >= uint64(float64(cap(w.RequestChan))*spillHighWaterFrac) && !w.Spill.full() {
+			if err := w.Spill.append(requestObj); err == nil {
+				continue
+			}
+		}
+
 		// this select/case/default is a non-blocking chan push
 		select {
-		case sendPool[qu].RequestChan <- requestObj:
+		case w.RequestChan <- requestObj:
 		default:
 			// metricize that we're dropping messages
 			dellchan <- qu
 			// kill off the oldest, not-in-flight message
 			// todo: it could possibly make sense to kill the inflight message, but...have to think on that more
-			<-sendPool[qu].RequestChan
+			<-w.RequestChan
 			// we attempt to send the current message one last time, but this it not guaranteed to work
 			select {
-			case sendPool[qu].RequestChan <- requestObj:
+			case w.RequestChan <- requestObj:
 			default:
 				// well, we tried our damndest, log it and move on
 				log.WithFields(log.Fields{
@@ -91,12 +133,24 @@ func handleIncomingEvent(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func sendEvent(client *http.Client, qu queueURL, req requestMessage) {
+func sendEvent(client *http.Client, qu queueURL, req requestMessage, policy RetryPolicy, breaker *circuitBreaker, fault *FaultInjection, auth authConfig) {
+	policy = policy.withDefaults()
+
 	start := time.Now()
 	var sent bool
-	sent = false
 	attempts := 0
-	sleepDuration := time.Millisecond * 100
+
+	if breaker != nil && !breaker.allow() {
+		log.WithFields(log.Fields{
+			"id":    req.UUID,
+			"queue": qu.Queue,
+			"url":   qu.URL,
+		}).Info("circuit-open-skip")
+		delfchan <- qu
+		return
+	}
+
+	sleepDuration := policy.InitialBackoff
 	for {
 		attempts++
 		httpReq, _ := http.NewRequest(req.Method, qu.URL, bytes.NewBuffer(req.Body))
@@ -106,37 +160,66 @@ func sendEvent(client *http.Client, qu queueURL, req requestMessage) {
 			}
 		}
 		httpReq.Header.Set("X-Wsq-Id", req.UUID)
-		resp, err := client.Do(httpReq)
 
+		var resp *http.Response
+		var err error
+		if signErr := auth.sign(httpReq, req); signErr != nil {
+			// an unsigned/unauthenticated request defeats the point of
+			// signing, so treat this the same as a failed send instead of
+			// relaying it anyway: skip client.Do and let the retry/backoff
+			// loop (and eventually delfchan) handle it
+			log.WithFields(log.Fields{"queue": qu.Queue, "url": qu.URL, "err": signErr}).Warn("auth-sign-failed")
+			err = signErr
+		} else if injected, faulted := applyFaultInjection(fault, req.Headers); faulted {
+			resp, err = injected.response()
+		} else {
+			resp, err = client.Do(httpReq)
+		}
+
+		statusCode := 0
 		if err == nil {
+			statusCode = resp.StatusCode
 			// get rid of the response, we don't care
 			// but we do need to clean it out, so the client can reuse the same connection
 			io.Copy(ioutil.Discard, resp.Body)
 			resp.Body.Close()
 		}
 
-		if err == nil && resp.StatusCode == 200 {
+		if err == nil && policy.isSuccess(statusCode) {
 			sent = true
 			break
 		}
 
-		// max duration, ever
-		// todo: make this configurable
-		if time.Since(start) > time.Second*60 {
+		if err == nil && !policy.isRetryable(statusCode) {
+			// e.g. a 404: retrying won't help, so fail fast
+			break
+		}
+
+		if time.Since(start) > policy.MaxElapsed {
 			break
 		}
 
-		// oops, didn't work; have a pause and try again in a bit
-		time.Sleep(sleepDuration)
+		// oops, didn't work; have a pause (with full jitter) and try again in a bit
+		time.Sleep(policy.jitter(sleepDuration))
 
 		// slowly ramp up our sleep interval, shall we? But cap it too
-		if sleepDuration < time.Duration(time.Second*15) {
-			sleepDuration = time.Duration(float64(sleepDuration) * 1.5)
-		} else {
-			sleepDuration = time.Duration(time.Second * 15)
+		if sleepDuration < policy.MaxBackoff {
+			sleepDuration = time.Duration(float64(sleepDuration) * policy.Multiplier)
+			if sleepDuration > policy.MaxBackoff {
+				sleepDuration = policy.MaxBackoff
+			}
 		}
 	}
 	elapsed := time.Since(start)
+	observeRelay(qu, attempts, elapsed.Seconds()*1e3)
+
+	if breaker != nil {
+		if sent {
+			breaker.recordSuccess()
+		} else {
+			breaker.recordFailure()
+		}
+	}
 
 	if sent {
 		deltchan <- qu
@@ -177,11 +260,24 @@ var dellchan = make(chan queueURL, 100)
 type worker struct {
 	QueueURL    queueURL
 	RequestChan chan requestMessage
-	QuitChan    chan bool
+	// Spill is the on-disk overflow log for this worker's queue, or nil if
+	// the target didn't configure SpillDir
+	Spill *spillQueue
+	// Retry is the backoff/success policy sendEvent uses for this target
+	Retry RetryPolicy
+	// Breaker is this target's circuit breaker, or nil if it didn't
+	// configure one
+	Breaker *circuitBreaker
+	// Fault is this target's fault injection config, or nil if disabled
+	Fault *FaultInjection
+	// Auth is this target's downstream authentication config
+	Auth authConfig
 }
 
 func (w worker) Start() {
+	workerWG.Add(1)
 	go func() {
+		defer workerWG.Done()
 		client := &http.Client{
 			// todo: reasonable default?
 			Timeout: 10 * time.Second,
@@ -189,8 +285,13 @@ func (w worker) Start() {
 			Jar: nil,
 		}
 		for {
-			work := <-w.RequestChan
-			sendEvent(client, w.QueueURL, work)
+			work, ok := <-w.RequestChan
+			if !ok {
+				// RequestChan was closed out from under us, usually as part
+				// of a graceful shutdown or a target being removed on reload
+				return
+			}
+			sendEvent(client, w.QueueURL, work, w.Retry, w.Breaker, w.Fault, w.Auth)
 		}
 	}()
 }
@@ -199,6 +300,102 @@ var sendPool = make(map[queueURL]worker)
 
 var targets targetList
 
+// targetsMu guards targets and sendPool, which are only ever mutated once
+// at startup unless an admin restart/reload is triggered afterwards
+var targetsMu sync.RWMutex
+
+// startWorker initializes counters, a RequestChan (and optional spill log)
+// for qu, starts its worker goroutine, and registers it in sendPool. The
+// caller is expected to hold targetsMu for writing.
+func startWorker(queue string, eventTarget eventTarget) {
+	qu := queueURL{queue, eventTarget.URL}
+	counters[qu] = counterVals{0, 0, 0, 0, 0}
+	if eventTarget.BufferLen <= 0 {
+		panic("Buffer length must be > 0")
+	}
+
+	w := worker{
+		QueueURL:    qu,
+		RequestChan: make(chan requestMessage, eventTarget.BufferLen),
+		Retry:       eventTarget.Retry,
+		Fault:       eventTarget.Fault,
+		Auth: authConfig{
+			Signing:     eventTarget.AuthSigning,
+			BearerToken: eventTarget.BearerToken,
+			Basic:       eventTarget.BasicAuth,
+		},
+	}
+	if eventTarget.SpillDir != "" {
+		sq, err := newSpillQueue(eventTarget.SpillDir, qu, eventTarget.SpillMaxBytes)
+		if err != nil {
+			log.WithFields(log.Fields{"queue": queue, "url": eventTarget.URL, "err": err}).Fatal("spill-open-failed")
+		}
+		w.Spill = sq
+	}
+	if eventTarget.Breaker != nil {
+		w.Breaker = newCircuitBreaker(qu, *eventTarget.Breaker)
+	}
+	sendPool[qu] = w
+	sendPool[qu].Start()
+	if w.Spill != nil {
+		// replay anything left over from a prior run, then keep draining
+		// the spool back into RequestChan as it empties
+		startSpillFeeder(w, w.Spill)
+	}
+	queueRegistry.Store(queue, true)
+}
+
+// resizeWorker rebuilds qu's worker with a freshly sized RequestChan when
+// a reload changes BufferLen, carrying over whatever was already queued
+// (spilling the remainder to disk if it doesn't fit and spill is
+// configured, dropping it otherwise) so the resize doesn't silently lose
+// in-flight messages. The caller is expected to hold targetsMu for
+// writing.
+func resizeWorker(queue string, eventTarget eventTarget, old worker) {
+	qu := queueURL{queue, eventTarget.URL}
+	if eventTarget.BufferLen <= 0 {
+		panic("Buffer length must be > 0")
+	}
+
+	if old.Spill != nil {
+		old.Spill.stop()
+	}
+
+	w := worker{
+		QueueURL:    qu,
+		RequestChan: make(chan requestMessage, eventTarget.BufferLen),
+		Retry:       eventTarget.Retry,
+		Fault:       eventTarget.Fault,
+		Spill:       old.Spill,
+		Auth: authConfig{
+			Signing:     eventTarget.AuthSigning,
+			BearerToken: eventTarget.BearerToken,
+			Basic:       eventTarget.BasicAuth,
+		},
+	}
+	if eventTarget.Breaker != nil {
+		w.Breaker = newCircuitBreaker(qu, *eventTarget.Breaker)
+	}
+
+	close(old.RequestChan)
+	for req := range old.RequestChan {
+		select {
+		case w.RequestChan <- req:
+		default:
+			if w.Spill == nil || w.Spill.append(req) != nil {
+				log.WithFields(log.Fields{"queue": queue, "url": eventTarget.URL}).Warn("reload-resize-dropped")
+			}
+		}
+	}
+
+	sendPool[qu] = w
+	sendPool[qu].Start()
+	if w.Spill != nil {
+		startSpillFeeder(w, w.Spill)
+	}
+	queueRegistry.Store(queue, true)
+}
+
 func main() {
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp:   true,
@@ -206,6 +403,7 @@ func main() {
 	})
 
 	configID := flag.String("config", "default", "Which stanza of the config to use")
+	configWatch := flag.String("config-watch", "", "Optional file to watch (fsnotify); writes trigger a config reload")
 	flag.Parse()
 
 	var ok bool
@@ -217,21 +415,13 @@ func main() {
 	// initialize counters to zero
 	// You don't _have_ to do this, but I like having all the counters
 	// reporting 0 immediately for stat collection purposes.
+	targetsMu.Lock()
 	for queue, eventTargets := range targets {
 		for _, eventTarget := range eventTargets {
-			qu := queueURL{queue, eventTarget.URL}
-			counters[qu] = counterVals{0, 0, 0, 0, 0}
-			if eventTarget.BufferLen <= 0 {
-				panic("Buffer length must be > 0")
-			}
-			sendPool[qu] = worker{
-				QueueURL:    qu,
-				RequestChan: make(chan requestMessage, eventTarget.BufferLen),
-				QuitChan:    make(chan bool),
-			}
-			sendPool[qu].Start()
+			startWorker(queue, eventTarget)
 		}
 	}
+	targetsMu.Unlock()
 
 	// goroutine to keep the counters up-to-date
 	go func() {
@@ -240,25 +430,41 @@ func main() {
 			select {
 			// you can't do counters[control].Current++ in go, so this mess is what results
 			case control := <-addchan:
+				targetsMu.Lock()
 				tmp := counters[control]
 				tmp.Current++
 				tmp.Total++
 				counters[control] = tmp
+				targetsMu.Unlock()
+				queueCurrent.WithLabelValues(control.Queue, control.URL).Inc()
+				queueTotal.WithLabelValues(control.Queue, control.URL).Inc()
 			case control := <-deltchan:
+				targetsMu.Lock()
 				tmp := counters[control]
 				tmp.Current--
 				tmp.Success++
 				counters[control] = tmp
+				targetsMu.Unlock()
+				queueCurrent.WithLabelValues(control.Queue, control.URL).Dec()
+				queueSuccess.WithLabelValues(control.Queue, control.URL).Inc()
 			case control := <-delfchan:
+				targetsMu.Lock()
 				tmp := counters[control]
 				tmp.Current--
 				tmp.Failure++
 				counters[control] = tmp
+				targetsMu.Unlock()
+				queueCurrent.WithLabelValues(control.Queue, control.URL).Dec()
+				queueFailure.WithLabelValues(control.Queue, control.URL).Inc()
 			case control := <-dellchan:
+				targetsMu.Lock()
 				tmp := counters[control]
 				tmp.Current--
 				tmp.Lost++
 				counters[control] = tmp
+				targetsMu.Unlock()
+				queueCurrent.WithLabelValues(control.Queue, control.URL).Dec()
+				queueLost.WithLabelValues(control.Queue, control.URL).Inc()
 			}
 		}
 	}()
@@ -275,6 +481,7 @@ func main() {
 				"mem.HeapSys":          mem.HeapSys,
 				"runtime.NumGoroutine": runtime.NumGoroutine(),
 			}).Info("metrics-mem")
+			targetsMu.RLock()
 			for cKeys, cVals := range counters {
 				log.WithFields(log.Fields{
 					"queue":   cKeys.Queue,
@@ -288,19 +495,25 @@ func main() {
 					"chanmax": cap(sendPool[cKeys].RequestChan),
 				}).Info("metrics-queue")
 			}
+			targetsMu.RUnlock()
 			time.Sleep(time.Second * 5)
 		}
 	}()
 
 	// Oh, hey, there's the webserver!
 	log.Info("starting server")
-	for queue := range targets {
-		log.Info("registering queue @ /" + queue)
-		http.HandleFunc("/"+queue, handleIncomingEvent)
-	}
-	http.HandleFunc("/", defaultHandler)
-	err := http.ListenAndServe(":8000", nil)
-	if err != nil {
+	admin := http.NewServeMux()
+	admin.Handle("/metrics", promhttp.Handler())
+
+	srv := &http.Server{Addr: ":8000", Handler: &dynamicMux{admin: admin}}
+	admin.HandleFunc("/_admin/shutdown", handleAdminShutdown(srv))
+	admin.HandleFunc("/_admin/restart", handleAdminRestart(*configWatch))
+
+	installSignalHandlers(srv)
+	installReloadHandlers(*configWatch)
+
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe: ", err)
 	}
 
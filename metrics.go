@@ -0,0 +1,64 @@
+package main
+
+// metrics.go exposes queue and relay stats as first-class Prometheus
+// collectors at /metrics, so operators can scrape sep instead of parsing
+// the periodic "metrics-queue" log line. The counters map and its
+// addchan/deltchan/delfchan/dellchan fan-in stay in place (they still
+// drive that log line); the aggregator goroutine in main() just also
+// updates these collectors as events come in.
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queueCurrent = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sep_queue_current",
+		Help: "Number of requestMessages currently queued for a target",
+	}, []string{"queue", "url"})
+
+	queueTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sep_queue_total",
+		Help: "Total requestMessages ever queued for a target",
+	}, []string{"queue", "url"})
+
+	queueSuccess = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sep_queue_success",
+		Help: "Total requestMessages successfully relayed to a target",
+	}, []string{"queue", "url"})
+
+	queueFailure = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sep_queue_failure",
+		Help: "Total requestMessages that failed to relay to a target (retries exhausted, non-retryable status, or open circuit breaker)",
+	}, []string{"queue", "url"})
+
+	queueLost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sep_queue_lost",
+		Help: "Total requestMessages dropped because a target's queue was full",
+	}, []string{"queue", "url"})
+
+	relayDurationMs = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sep_relay_duration_ms",
+		Help:    "Time spent relaying a requestMessage to a target, including retries",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+	}, []string{"queue", "url"})
+
+	relayAttempts = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sep_relay_attempts",
+		Help:    "Number of attempts made to relay a requestMessage to a target",
+		Buckets: prometheus.LinearBuckets(1, 1, 10),
+	}, []string{"queue", "url"})
+
+	breakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sep_circuit_breaker_state",
+		Help: "Circuit breaker state for a target: 0=closed, 1=open, 2=half-open",
+	}, []string{"queue", "url"})
+)
+
+// observeRelay records a completed sendEvent attempt (successful or not)
+// against the relay duration/attempts histograms.
+func observeRelay(qu queueURL, attempts int, elapsedMs float64) {
+	relayDurationMs.WithLabelValues(qu.Queue, qu.URL).Observe(elapsedMs)
+	relayAttempts.WithLabelValues(qu.Queue, qu.URL).Observe(float64(attempts))
+}
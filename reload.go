@@ -0,0 +1,175 @@
+package main
+
+// reload.go lets operators add/remove queues and targets, or resize a
+// target's BufferLen, without restarting the process and (apart from a
+// BufferLen shrink on a target without SpillDir) without losing in-flight
+// messages, and without stalling inbound traffic on other queues while a
+// removed target drains. ReloadConfig reads and JSON-decodes a fresh
+// targetList from path and is wired to both SIGHUP and an optional
+// fsnotify watcher on that same path.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+)
+
+// queueRegistry tracks which queue names are currently routable, so
+// dynamicMux can look them up at request time instead of requiring routes
+// to be registered up front.
+var queueRegistry sync.Map
+
+// ReloadConfig reads the targetList at path (the same JSON shape used to
+// populate allTargets' stanzas) and rebuilds the live targets/sendPool in
+// place: targets that still exist keep their worker and RequestChan
+// untouched (unless BufferLen changed, in which case the RequestChan is
+// rebuilt via resizeWorker), new targets get a fresh worker, and removed
+// targets are drained before being torn down. Nothing queued is dropped,
+// except that a BufferLen shrink on a target without SpillDir drops
+// whatever no longer fits in the new RequestChan. The drain of removed targets happens after targetsMu is released, so a
+// slow drain on one target doesn't stall inbound traffic on every queue.
+func ReloadConfig(path string) error {
+	if path == "" {
+		return fmt.Errorf("sep: no config file to reload from (see -config-watch)")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("sep: reading config %q: %w", path, err)
+	}
+
+	var newTargets targetList
+	if err := json.Unmarshal(data, &newTargets); err != nil {
+		return fmt.Errorf("sep: parsing config %q: %w", path, err)
+	}
+	if len(newTargets) == 0 {
+		return fmt.Errorf("sep: config %q produced no targets", path)
+	}
+
+	type removedTarget struct {
+		qu queueURL
+		w  worker
+	}
+	var removed []removedTarget
+
+	targetsMu.Lock()
+
+	wanted := make(map[queueURL]bool)
+	for queue, eventTargets := range newTargets {
+		for _, eventTarget := range eventTargets {
+			qu := queueURL{queue, eventTarget.URL}
+			wanted[qu] = true
+			switch existing, exists := sendPool[qu]; {
+			case !exists:
+				startWorker(queue, eventTarget)
+			case uint64(cap(existing.RequestChan)) != eventTarget.BufferLen:
+				resizeWorker(queue, eventTarget, existing)
+			}
+		}
+	}
+
+	for qu, w := range sendPool {
+		if wanted[qu] {
+			continue
+		}
+		removed = append(removed, removedTarget{qu, w})
+		delete(sendPool, qu)
+		delete(counters, qu)
+	}
+
+	queueRegistry.Range(func(key, _ interface{}) bool {
+		if _, stillWanted := newTargets[key.(string)]; !stillWanted {
+			queueRegistry.Delete(key)
+		}
+		return true
+	})
+
+	targets = newTargets
+	targetsMu.Unlock()
+
+	deadline := time.Now().Add(drainDeadline)
+	for _, r := range removed {
+		log.WithFields(log.Fields{"queue": r.qu.Queue, "url": r.qu.URL}).Info("reload-removing-target")
+		drainWorker(r.qu, r.w, deadline)
+	}
+
+	log.Info("config-reloaded")
+	return nil
+}
+
+// installReloadHandlers wires ReloadConfig(watchPath) up to SIGHUP, and
+// additionally to fsnotify write/create events on watchPath if one was given. If
+// watchPath is empty, SIGHUP is still trapped (so it doesn't kill the
+// process per Go's default disposition) but reloads will simply fail with
+// a logged error, since there's no file to re-read.
+func installReloadHandlers(watchPath string) {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			log.Info("sighup-received")
+			if err := ReloadConfig(watchPath); err != nil {
+				log.WithFields(log.Fields{"err": err}).Warn("sighup-reload-failed")
+			}
+		}
+	}()
+
+	if watchPath == "" {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("config-watch-disabled")
+		return
+	}
+	if err := watcher.Add(watchPath); err != nil {
+		log.WithFields(log.Fields{"path": watchPath, "err": err}).Warn("config-watch-disabled")
+		watcher.Close()
+		return
+	}
+
+	go func() {
+		for event := range watcher.Events {
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			log.WithFields(log.Fields{"path": event.Name}).Info("config-watch-triggered")
+			if err := ReloadConfig(watchPath); err != nil {
+				log.WithFields(log.Fields{"err": err}).Warn("config-watch-reload-failed")
+			}
+		}
+	}()
+}
+
+// dynamicMux dispatches to handleIncomingEvent for any path whose queue is
+// currently in queueRegistry, and to admin/defaultHandler otherwise. Unlike
+// http.ServeMux, it needs no up-front route registration, so queues added
+// by ReloadConfig become reachable immediately.
+type dynamicMux struct {
+	admin *http.ServeMux
+}
+
+func (m *dynamicMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/_admin/") || r.URL.Path == "/metrics" {
+		m.admin.ServeHTTP(w, r)
+		return
+	}
+
+	queue := strings.TrimPrefix(r.URL.Path, "/")
+	if _, ok := queueRegistry.Load(queue); ok {
+		handleIncomingEvent(w, r)
+		return
+	}
+
+	defaultHandler(w, r)
+}
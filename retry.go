@@ -0,0 +1,93 @@
+package main
+
+// retry.go holds the per-target retry/backoff policy sendEvent uses. The
+// zero value of RetryPolicy keeps the timing sendEvent used to have
+// hardcoded: a 60s deadline and 100ms-15s (x1.5) backoff with no jitter.
+// Unlike the old hardcoded check for HTTP 200, it counts any 2xx as success
+// and fails fast on 4xx.
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy configures how sendEvent retries a failed relay for a single
+// eventTarget.
+type RetryPolicy struct {
+	// InitialBackoff is the sleep before the second attempt
+	InitialBackoff time.Duration
+	// MaxBackoff caps how long the backoff is allowed to ramp up to
+	MaxBackoff time.Duration
+	// Multiplier is applied to the backoff after each failed attempt
+	Multiplier float64
+	// JitterFraction is how much of the computed backoff is randomized,
+	// from 0 (no jitter) to 1 (full jitter: sleep = rand(0, computed))
+	JitterFraction float64
+	// MaxElapsed is the overall deadline across all attempts
+	MaxElapsed time.Duration
+	// SuccessCodes are the HTTP status codes that count as delivered; if
+	// empty, any 2xx counts
+	SuccessCodes []int
+	// RetryableCodes are non-success codes worth retrying beyond the
+	// default; if empty, everything but 4xx is retried (4xx fails fast)
+	RetryableCodes []int
+}
+
+// withDefaults fills in the zero-value fields of p with sendEvent's
+// original hardcoded behavior.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 100 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 15 * time.Second
+	}
+	if p.Multiplier <= 0 {
+		p.Multiplier = 1.5
+	}
+	if p.MaxElapsed <= 0 {
+		p.MaxElapsed = 60 * time.Second
+	}
+	return p
+}
+
+// isSuccess reports whether statusCode counts as a delivered request.
+func (p RetryPolicy) isSuccess(statusCode int) bool {
+	if len(p.SuccessCodes) > 0 {
+		return containsCode(p.SuccessCodes, statusCode)
+	}
+	return statusCode >= 200 && statusCode < 300
+}
+
+// isRetryable reports whether a non-success statusCode is worth retrying.
+// By default, 4xx client errors fail fast (retrying won't change the
+// outcome) and everything else is retried.
+func (p RetryPolicy) isRetryable(statusCode int) bool {
+	if containsCode(p.RetryableCodes, statusCode) {
+		return true
+	}
+	return statusCode < 400 || statusCode >= 500
+}
+
+// jitter applies full (or partial, per JitterFraction) jitter to computed,
+// so many targets recovering at once don't all retry in lockstep.
+func (p RetryPolicy) jitter(computed time.Duration) time.Duration {
+	if p.JitterFraction <= 0 {
+		return computed
+	}
+	jitterable := time.Duration(float64(computed) * p.JitterFraction)
+	if jitterable <= 0 {
+		return computed
+	}
+	base := computed - jitterable
+	return base + time.Duration(rand.Int63n(int64(jitterable)+1))
+}
+
+func containsCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,273 @@
+package main
+
+// spill.go implements an optional on-disk overflow log for an eventTarget's
+// RequestChan. When an inbound burst pushes a queue above its high-water
+// mark we'd rather write requestMessages to disk than drop them on the
+// floor; a feeder goroutine drains the log back into RequestChan once the
+// channel has room again, and anything left over on disk is replayed on
+// the next start so a restart doesn't lose queued work.
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// spillHighWaterFrac is the RequestChan fill ratio above which new messages
+// are spilled to disk instead of being pushed into the channel.
+const spillHighWaterFrac = 0.5
+
+// spillLowWaterFrac is the RequestChan fill ratio below which the feeder
+// resumes draining the spill log back into the channel. Kept well below
+// spillHighWaterFrac so the two don't fight over the same fill level and
+// spill/feed repeatedly under sustained load near the high-water mark.
+const spillLowWaterFrac = 0.25
+
+// spillPollInterval is how often the feeder goroutine checks whether it's
+// safe to push another message from disk into RequestChan.
+const spillPollInterval = 250 * time.Millisecond
+
+// spillQueue is the on-disk overflow log for a single worker's queue. It's
+// a simple append-only file of gob-encoded requestMessages, each prefixed
+// with its own length, read back in order from the front.
+type spillQueue struct {
+	path string
+
+	mu       sync.Mutex
+	writer   *os.File
+	size     uint64
+	maxBytes uint64
+
+	// stopCh/doneCh let stop() ask the feeder goroutine to exit and wait
+	// for it to actually do so, so a caller can be sure no more sends to
+	// RequestChan are in flight before it closes that channel.
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// spillFilePath derives a stable on-disk filename for a queueURL so that
+// restarts can find and replay the same spool file.
+func spillFilePath(dir string, qu queueURL) string {
+	repl := strings.NewReplacer("/", "_", ":", "_", "?", "_", "&", "_", "*", "_")
+	name := repl.Replace(qu.Queue) + "__" + repl.Replace(qu.URL) + ".spool"
+	return filepath.Join(dir, name)
+}
+
+// newSpillQueue opens (creating if necessary) the spool file for qu under
+// dir, ready for appends.
+func newSpillQueue(dir string, qu queueURL, maxBytes uint64) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := spillFilePath(dir, qu)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &spillQueue{path: path, writer: f, size: uint64(info.Size()), maxBytes: maxBytes}, nil
+}
+
+// full reports whether the spool has reached its configured size cap, at
+// which point handleIncomingEvent stops spilling and falls back to the
+// in-memory RequestChan (dropping its oldest message when full) rather than
+// growing the file unbounded.
+func (s *spillQueue) full() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxBytes > 0 && s.size >= s.maxBytes
+}
+
+// append gob-encodes req and writes it, length-prefixed, to the spool file.
+func (s *spillQueue) append(req requestMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var buf strings.Builder
+	if err := gob.NewEncoder(&buf).Encode(req); err != nil {
+		return err
+	}
+	payload := buf.String()
+
+	n, err := s.writer.WriteString(encodeSpillLength(uint32(len(payload))) + payload)
+	if err != nil {
+		return err
+	}
+	s.size += uint64(n)
+	return nil
+}
+
+// encodeSpillLength packs a 4-byte big-endian length prefix as raw bytes
+// wrapped in a string so it can be concatenated with the gob payload above.
+func encodeSpillLength(n uint32) string {
+	b := make([]byte, 4)
+	b[0] = byte(n >> 24)
+	b[1] = byte(n >> 16)
+	b[2] = byte(n >> 8)
+	b[3] = byte(n)
+	return string(b)
+}
+
+// drain reads the requestMessages in the spool file, in order, invoking fn
+// for each until fn returns false, then compacts the file so that only the
+// records fn did not take (if any) remain. It's used both for startup
+// replay and for the steady-state feeder.
+func (s *spillQueue) drain(fn func(requestMessage) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	consumed := int64(0)
+	for {
+		lenBuf := make([]byte, 4)
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			if err != io.EOF {
+				// a torn length prefix, e.g. from a crash mid-write; stop
+				// here rather than erroring out, so consumed (everything
+				// we did parse cleanly) still gets compacted below
+				log.WithFields(log.Fields{"path": s.path, "err": err}).Warn("spill-torn-record")
+			}
+			break
+		}
+		recLen := uint32(lenBuf[0])<<24 | uint32(lenBuf[1])<<16 | uint32(lenBuf[2])<<8 | uint32(lenBuf[3])
+		payload := make([]byte, recLen)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			// torn payload; same story as above
+			log.WithFields(log.Fields{"path": s.path, "err": err}).Warn("spill-torn-record")
+			break
+		}
+
+		var req requestMessage
+		if err := gob.NewDecoder(strings.NewReader(string(payload))).Decode(&req); err != nil {
+			log.WithFields(log.Fields{"path": s.path, "err": err}).Warn("spill-decode-error")
+			// skip the undecodable record, but count its bytes so the
+			// compaction offset stays on a record boundary
+			consumed += int64(4 + recLen)
+			continue
+		}
+
+		if !fn(req) {
+			// caller couldn't take the message right now; leave it and
+			// everything after it on disk for next time
+			break
+		}
+		consumed += int64(4 + recLen)
+	}
+
+	return s.compact(consumed)
+}
+
+// compact removes the first n already-consumed bytes from the spool file,
+// keeping whatever's left (if anything) for the next drain.
+func (s *spillQueue) compact(n int64) error {
+	if n <= 0 {
+		return nil
+	}
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(n, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	remainder, err := ioutilReadAllClose(f)
+	if err != nil {
+		return err
+	}
+
+	if err := s.writer.Close(); err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path, remainder, 0644); err != nil {
+		return err
+	}
+	w, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.writer = w
+	s.size = uint64(len(remainder))
+	return nil
+}
+
+// ioutilReadAllClose reads the remainder of f and closes it either way.
+func ioutilReadAllClose(f *os.File) ([]byte, error) {
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// startSpillFeeder launches the goroutine that drains w's spool file back
+// into RequestChan whenever the channel has fallen to the low-water mark,
+// and replays anything already on disk from a previous run first.
+func startSpillFeeder(w worker, sq *spillQueue) {
+	sq.stopCh = make(chan struct{})
+	sq.doneCh = make(chan struct{})
+
+	replay := func() {
+		err := sq.drain(func(req requestMessage) bool {
+			select {
+			case w.RequestChan <- req:
+				return true
+			default:
+				return false
+			}
+		})
+		if err != nil {
+			log.WithFields(log.Fields{"queue": w.QueueURL.Queue, "url": w.QueueURL.URL, "err": err}).Warn("spill-drain-error")
+		}
+	}
+
+	// replay anything left over from a prior run before we start feeding
+	// live overflow
+	replay()
+
+	go func() {
+		defer close(sq.doneCh)
+		ticker := time.NewTicker(spillPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sq.stopCh:
+				return
+			case <-ticker.C:
+				lowWater := uint64(float64(cap(w.RequestChan)) * spillLowWaterFrac)
+				if uint64(len(w.RequestChan)) <= lowWater {
+					replay()
+				}
+			}
+		}
+	}()
+}
+
+// stop asks the feeder goroutine to exit and blocks until it has, so the
+// caller can safely close RequestChan right after without racing a send
+// from a still-running feeder.
+func (s *spillQueue) stop() {
+	if s.stopCh == nil {
+		return
+	}
+	close(s.stopCh)
+	<-s.doneCh
+}